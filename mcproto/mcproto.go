@@ -0,0 +1,225 @@
+// Package mcproto implements the low-level framing of the Minecraft Java
+// Edition network protocol: VarInts, length-prefixed strings, and the
+// packet framing used by the Server List Ping handshake.
+// http://wiki.vg/Protocol
+package mcproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// PacketWriter buffers and encodes the primitive types used by the
+// Minecraft protocol onto an underlying io.Writer.
+type PacketWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func NewPacketWriter(w io.Writer) *PacketWriter {
+	return &PacketWriter{w: bufio.NewWriter(w)}
+}
+
+// WriteVarInt writes v using the protocol's VarInt encoding (LEB128 over
+// the raw bits of a 32-bit value; unlike protobuf VarInts this is not
+// zigzag-encoded).
+func (pw *PacketWriter) WriteVarInt(v int32) error {
+	if pw.err != nil {
+		return pw.err
+	}
+	var buf [5]byte
+	n := PutVarInt(buf[:], v)
+	_, pw.err = pw.w.Write(buf[:n])
+	return pw.err
+}
+
+// WriteString writes a VarInt length prefix followed by the UTF-8 bytes
+// of s.
+func (pw *PacketWriter) WriteString(s string) error {
+	if err := pw.WriteVarInt(int32(len(s))); err != nil {
+		return err
+	}
+	_, pw.err = pw.w.WriteString(s)
+	return pw.err
+}
+
+// WriteUnsignedShort writes v as a big-endian uint16.
+func (pw *PacketWriter) WriteUnsignedShort(v uint16) error {
+	if pw.err != nil {
+		return pw.err
+	}
+	pw.err = binary.Write(pw.w, binary.BigEndian, v)
+	return pw.err
+}
+
+// WriteByte writes a single raw byte.
+func (pw *PacketWriter) WriteByte(b byte) error {
+	if pw.err != nil {
+		return pw.err
+	}
+	pw.err = pw.w.WriteByte(b)
+	return pw.err
+}
+
+// WritePacket frames payload as a complete protocol packet: a VarInt
+// length (covering both the id and the payload), the packet id as a
+// VarInt, then the payload itself.
+func (pw *PacketWriter) WritePacket(id int32, payload []byte) error {
+	var idBuf [5]byte
+	idLen := PutVarInt(idBuf[:], id)
+
+	if err := pw.WriteVarInt(int32(idLen) + int32(len(payload))); err != nil {
+		return err
+	}
+	if _, pw.err = pw.w.Write(idBuf[:idLen]); pw.err != nil {
+		return pw.err
+	}
+	_, pw.err = pw.w.Write(payload)
+	return pw.err
+}
+
+// Flush flushes any buffered data to the underlying writer.
+func (pw *PacketWriter) Flush() error {
+	if pw.err != nil {
+		return pw.err
+	}
+	pw.err = pw.w.Flush()
+	return pw.err
+}
+
+// PacketReader decodes the primitive types used by the Minecraft protocol
+// from an underlying io.Reader.
+type PacketReader struct {
+	r *bufio.Reader
+}
+
+func NewPacketReader(r io.Reader) *PacketReader {
+	return &PacketReader{r: bufio.NewReader(r)}
+}
+
+// ReadVarInt reads a protocol VarInt.
+func (pr *PacketReader) ReadVarInt() (int32, error) {
+	return ReadVarInt(pr.r)
+}
+
+// ReadString reads a VarInt length prefix followed by that many UTF-8
+// bytes.
+func (pr *PacketReader) ReadString() (string, error) {
+	length, err := pr.ReadVarInt()
+	if err != nil {
+		return "", err
+	}
+	if length < 0 {
+		return "", fmt.Errorf("mcproto: negative string length %d", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(pr.r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// ReadUnsignedShort reads a big-endian uint16.
+func (pr *PacketReader) ReadUnsignedShort() (v uint16, err error) {
+	err = binary.Read(pr.r, binary.BigEndian, &v)
+	return
+}
+
+// ReadByte reads a single raw byte.
+func (pr *PacketReader) ReadByte() (byte, error) {
+	return pr.r.ReadByte()
+}
+
+// ReadPacket reads a complete framed packet: a VarInt length, then that
+// many bytes, splitting off the leading VarInt packet id from the
+// remaining payload.
+func (pr *PacketReader) ReadPacket() (id int32, payload []byte, err error) {
+	length, err := pr.ReadVarInt()
+	if err != nil {
+		return
+	}
+	if length < 0 {
+		err = fmt.Errorf("mcproto: negative packet length %d", length)
+		return
+	}
+	buf := make([]byte, length)
+	if _, err = io.ReadFull(pr.r, buf); err != nil {
+		return
+	}
+
+	id, idLen, err := DecodeVarInt(buf)
+	if err != nil {
+		return
+	}
+	payload = buf[idLen:]
+	return
+}
+
+// PutVarInt encodes v into buf (which must be at least 5 bytes long) using
+// the protocol's VarInt encoding and returns the number of bytes written.
+func PutVarInt(buf []byte, v int32) int {
+	u := uint32(v)
+	i := 0
+	for {
+		b := byte(u & 0x7F)
+		u >>= 7
+		if u != 0 {
+			b |= 0x80
+		}
+		buf[i] = b
+		i++
+		if u == 0 {
+			break
+		}
+	}
+	return i
+}
+
+// ReadVarInt decodes a protocol VarInt from r.
+func ReadVarInt(r io.ByteReader) (int32, error) {
+	var result uint32
+	var shift uint
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		result |= uint32(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		shift += 7
+		if shift >= 35 {
+			return 0, fmt.Errorf("mcproto: VarInt is too long")
+		}
+	}
+	return int32(result), nil
+}
+
+// DecodeVarInt decodes a VarInt from the start of buf and returns the
+// value along with the number of bytes it occupied.
+func DecodeVarInt(buf []byte) (value int32, n int, err error) {
+	var result uint32
+	var shift uint
+	for {
+		if n >= len(buf) {
+			err = fmt.Errorf("mcproto: VarInt runs past end of buffer")
+			return
+		}
+		b := buf[n]
+		n++
+		result |= uint32(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		shift += 7
+		if shift >= 35 {
+			err = fmt.Errorf("mcproto: VarInt is too long")
+			return
+		}
+	}
+	value = int32(result)
+	return
+}
@@ -0,0 +1,118 @@
+package mcproto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVarIntRoundTrip(t *testing.T) {
+	cases := []struct {
+		value   int32
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{255, []byte{0xff, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2147483647, []byte{0xff, 0xff, 0xff, 0xff, 0x07}},
+		{-1, []byte{0xff, 0xff, 0xff, 0xff, 0x0f}},
+	}
+
+	for _, c := range cases {
+		var buf [5]byte
+		n := PutVarInt(buf[:], c.value)
+		if !bytes.Equal(buf[:n], c.encoded) {
+			t.Errorf("PutVarInt(%d) = % x, want % x", c.value, buf[:n], c.encoded)
+		}
+
+		got, err := ReadVarInt(bytes.NewReader(c.encoded))
+		if err != nil {
+			t.Errorf("ReadVarInt(% x) returned error: %v", c.encoded, err)
+		}
+		if got != c.value {
+			t.Errorf("ReadVarInt(% x) = %d, want %d", c.encoded, got, c.value)
+		}
+
+		value, n, err := DecodeVarInt(c.encoded)
+		if err != nil {
+			t.Errorf("DecodeVarInt(% x) returned error: %v", c.encoded, err)
+		}
+		if value != c.value || n != len(c.encoded) {
+			t.Errorf("DecodeVarInt(% x) = (%d, %d), want (%d, %d)", c.encoded, value, n, c.value, len(c.encoded))
+		}
+	}
+}
+
+func TestReadVarIntTooLong(t *testing.T) {
+	buf := []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80}
+	if _, err := ReadVarInt(bytes.NewReader(buf)); err == nil {
+		t.Error("ReadVarInt on an over-long VarInt should have returned an error")
+	}
+}
+
+func TestPacketWriterWritePacket(t *testing.T) {
+	var buf bytes.Buffer
+	pw := NewPacketWriter(&buf)
+	if err := pw.WritePacket(0x00, []byte("hi")); err != nil {
+		t.Fatalf("WritePacket returned error: %v", err)
+	}
+	if err := pw.Flush(); err != nil {
+		t.Fatalf("Flush returned error: %v", err)
+	}
+
+	// length(3) id(0x00) "hi"
+	want := []byte{0x03, 0x00, 'h', 'i'}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("WritePacket wrote % x, want % x", buf.Bytes(), want)
+	}
+}
+
+func TestPacketReaderReadPacket(t *testing.T) {
+	data := []byte{0x03, 0x00, 'h', 'i'}
+	pr := NewPacketReader(bytes.NewReader(data))
+
+	id, payload, err := pr.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket returned error: %v", err)
+	}
+	if id != 0x00 {
+		t.Errorf("ReadPacket id = %d, want 0", id)
+	}
+	if string(payload) != "hi" {
+		t.Errorf("ReadPacket payload = %q, want %q", payload, "hi")
+	}
+}
+
+func TestPacketReaderReadString(t *testing.T) {
+	var buf bytes.Buffer
+	pw := NewPacketWriter(&buf)
+	pw.WriteString("hello, world")
+	pw.Flush()
+
+	pr := NewPacketReader(&buf)
+	got, err := pr.ReadString()
+	if err != nil {
+		t.Fatalf("ReadString returned error: %v", err)
+	}
+	if got != "hello, world" {
+		t.Errorf("ReadString = %q, want %q", got, "hello, world")
+	}
+}
+
+func TestPacketReaderReadUnsignedShort(t *testing.T) {
+	var buf bytes.Buffer
+	pw := NewPacketWriter(&buf)
+	pw.WriteUnsignedShort(25565)
+	pw.Flush()
+
+	pr := NewPacketReader(&buf)
+	got, err := pr.ReadUnsignedShort()
+	if err != nil {
+		t.Fatalf("ReadUnsignedShort returned error: %v", err)
+	}
+	if got != 25565 {
+		t.Errorf("ReadUnsignedShort = %d, want 25565", got)
+	}
+}
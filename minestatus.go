@@ -2,15 +2,29 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/natmeox/slack-minestatus/mcproto"
 )
 
 var Config struct {
@@ -20,9 +34,35 @@ var Config struct {
 	WebAddress    string
 	MinecraftHost string
 	MinecraftPort int
+	// QueryPort is the UDP port the GS4 Query protocol listens on. Defaults
+	// to MinecraftPort when zero, since that's the common server.properties setup.
+	QueryPort int
+	// StatusBackend selects how GetStatus talks to the server: "slp" for the
+	// 1.7+ JSON Server List Ping, "query" for the GS4 UDP Query protocol, or
+	// "auto" to try Query first and fall back to SLP. Defaults to "slp".
+	StatusBackend string
+	// BedrockHost and BedrockPort point at a Bedrock Edition server to query
+	// over RakNet. BedrockHost is left empty to disable the "bedrock"
+	// subcommand entirely.
+	BedrockHost string
+	BedrockPort int
+	// SlackSigningSecret verifies that incoming requests actually came from
+	// Slack. https://api.slack.com/authentication/verifying-requests-from-slack
+	SlackSigningSecret string
+	// CacheTTLSeconds is how long a fetched status is served from Cache
+	// before GetStatus is called again. Defaults to 10 when zero.
+	CacheTTLSeconds int
+	// PresenceChannel is the Slack channel join/leave notifications are
+	// posted to. Left empty, the background poller doesn't run at all.
+	PresenceChannel string
+	// PresencePollSeconds is how often the background poller checks for
+	// player list changes. Defaults to CacheTTLSeconds when zero.
+	PresencePollSeconds int
 }
 
 var MinecraftAddress *net.TCPAddr
+var MinecraftQueryAddress *net.UDPAddr
+var MinecraftBedrockAddress *net.UDPAddr
 
 type SlackMessage struct {
 	ChannelName string
@@ -37,15 +77,72 @@ type SlackResponse struct {
 	Text string `json:"text"`
 }
 
+// SlackDelayedResponse is posted to a slash command's response_url once
+// we've actually fetched the status, since that can take longer than
+// Slack's 3-second ack deadline.
+type SlackDelayedResponse struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+// SlackEvent is the "event" payload of an Events API callback we care
+// about (currently just app_mention).
+// https://api.slack.com/events/app_mention
+type SlackEvent struct {
+	Type    string `json:"type"`
+	Text    string `json:"text"`
+	Channel string `json:"channel"`
+	User    string `json:"user"`
+}
+
+// SlackEventPayload is the top-level body Slack posts to an Events API
+// request URL, covering both the one-time URL verification handshake and
+// ongoing event_callback deliveries.
+// https://api.slack.com/events-api
+type SlackEventPayload struct {
+	Type      string     `json:"type"`
+	Challenge string     `json:"challenge"`
+	Event     SlackEvent `json:"event"`
+}
+
 type MinecraftStatus struct {
 	ProtocolVersion uint64
 	ServerVersion   string
 	Motd            string
 	Players         uint64
 	MaxPlayers      uint64
+
+	// Plugins, Map, GameType, and PlayerNames are only populated by the
+	// Query backend; the JSON Server List Ping doesn't expose them.
+	Plugins     string
+	Map         string
+	GameType    string
+	PlayerNames []string
 }
 
+// GetStatus fetches the current server status using the backend selected by
+// Config.StatusBackend ("slp", "query", or "auto"). It defaults to "slp".
 func GetStatus() (stat *MinecraftStatus, err error) {
+	switch Config.StatusBackend {
+	case "query":
+		return getStatusQuery()
+	case "auto":
+		stat, err = getStatusQuery()
+		if err == nil {
+			return
+		}
+		log.Println("Query probe failed, falling back to SLP:", err)
+		return getStatusSLP()
+	default:
+		return getStatusSLP()
+	}
+}
+
+// getStatusSLP fetches status using the 1.7+ Server List Ping handshake:
+// http://wiki.vg/Server_List_Ping
+// If the server doesn't answer the JSON handshake at all (likely a pre-1.7
+// server), it falls back to the legacy 1.6 ping.
+func getStatusSLP() (stat *MinecraftStatus, err error) {
 	log.Println("Connecting to", MinecraftAddress)
 	netConn, err := net.DialTCP("tcp", nil, MinecraftAddress)
 	if err != nil {
@@ -53,93 +150,574 @@ func GetStatus() (stat *MinecraftStatus, err error) {
 	}
 	defer netConn.Close()
 	log.Println("Connected!")
-	conn := bufio.NewReadWriter(bufio.NewReader(netConn), bufio.NewWriter(netConn))
+	netConn.SetDeadline(time.Now().Add(5 * time.Second))
 
-	// Send a 1.7 Server List Ping
-	// http://wiki.vg/Server_List_Ping (mostly)
-	data := make([]byte, 256)
+	pw := mcproto.NewPacketWriter(netConn)
 
-	err = binary.Write(conn, binary.BigEndian, uint8(0x0F))
+	// Handshake packet: protocol version, server address, server port, and
+	// next state (1 = status).
+	var handshake bytes.Buffer
+	hpw := mcproto.NewPacketWriter(&handshake)
+	// Server List says to use 4 but 1.7.10 is actually 5.
+	hpw.WriteVarInt(5)
+	hpw.WriteString(Config.MinecraftHost)
+	hpw.WriteUnsignedShort(uint16(Config.MinecraftPort))
+	hpw.WriteVarInt(1)
+	if err = hpw.Flush(); err != nil {
+		return
+	}
+	err = pw.WritePacket(0x00, handshake.Bytes())
+	if err != nil {
+		return
+	}
 
-	n := binary.PutUvarint(data, 0)
-	err = binary.Write(conn, binary.BigEndian, data[:n])
+	// Status request packet: empty payload.
+	err = pw.WritePacket(0x00, nil)
 	if err != nil {
 		return
 	}
+	if err = pw.Flush(); err != nil {
+		return
+	}
+	log.Println("Sent SLP handshake, about to read...")
 
-	// Server List says to use 4 but 1.7.10 is actually 5.
-	n = binary.PutUvarint(data, 5)
-	err = binary.Write(conn, binary.BigEndian, data[:n])
+	pr := mcproto.NewPacketReader(netConn)
+	_, payload, err := pr.ReadPacket()
+	if err != nil {
+		log.Println("SLP handshake got no response, trying legacy ping:", err)
+		return getStatusLegacy()
+	}
+
+	body := mcproto.NewPacketReader(bytes.NewReader(payload))
+	jsonText, err := body.ReadString()
 	if err != nil {
 		return
 	}
 
-	n = binary.PutUvarint(data, uint64(len(Config.MinecraftHost)))
-	err = binary.Write(conn, binary.BigEndian, data[:n])
+	var resp SLPStatusResponse
+	err = json.Unmarshal([]byte(jsonText), &resp)
+	if err != nil {
+		return
+	}
+
+	stat = &MinecraftStatus{
+		ProtocolVersion: uint64(resp.Version.Protocol),
+		ServerVersion:   resp.Version.Name,
+		Motd:            decodeChatText(resp.Description),
+		Players:         uint64(resp.Players.Online),
+		MaxPlayers:      uint64(resp.Players.Max),
+	}
+
+	// players.sample is optional and, even when present, is usually capped
+	// to a handful of names by the server -- good enough for a status
+	// report, not reliable enough to diff for presence changes.
+	for _, player := range resp.Players.Sample {
+		if player.Name != "" {
+			stat.PlayerNames = append(stat.PlayerNames, player.Name)
+		}
+	}
+	return
+}
+
+// SLPStatusResponse is the JSON body of a 1.7+ Server List Ping response.
+// http://wiki.vg/Server_List_Ping#Status_Response
+type SLPStatusResponse struct {
+	Version struct {
+		Name     string `json:"name"`
+		Protocol int64  `json:"protocol"`
+	} `json:"version"`
+	Players struct {
+		Online int64 `json:"online"`
+		Max    int64 `json:"max"`
+		Sample []struct {
+			Name string `json:"name"`
+		} `json:"sample"`
+	} `json:"players"`
+	// Description is a chat component: either a bare string, or an object
+	// with at least a "text" field (and possibly "extra" children). Decode
+	// it with decodeChatText rather than asserting it's a plain string.
+	Description json.RawMessage `json:"description"`
+}
+
+// chatComponent is the minimal shape of a Minecraft chat component we
+// need to extract plain text from a server's MOTD.
+// https://wiki.vg/Chat
+type chatComponent struct {
+	Text  string          `json:"text"`
+	Extra []chatComponent `json:"extra"`
+}
+
+// decodeChatText extracts the plain text from a chat component, which
+// servers send either as a bare JSON string or as an object (with
+// possible "extra" children) depending on version and configuration.
+func decodeChatText(raw json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+
+	var component chatComponent
+	if err := json.Unmarshal(raw, &component); err != nil {
+		return ""
+	}
+	text = component.Text
+	for _, extra := range component.Extra {
+		text += extra.Text
+	}
+	return text
+}
+
+// getStatusLegacy fetches status using the pre-1.7 "legacy" Server List
+// Ping (protocol version 1.6, a.k.a. the 0xFE 0x01 ping): the server
+// responds with a kick packet (0xFF) containing a UTF-16BE string of the
+// form "\xa7\x31\x00<protocol>\x00<version>\x00<motd>\x00<online>\x00<max>".
+// http://wiki.vg/Server_List_Ping#1.6
+func getStatusLegacy() (stat *MinecraftStatus, err error) {
+	log.Println("Connecting to", MinecraftAddress, "for legacy ping")
+	netConn, err := net.DialTCP("tcp", nil, MinecraftAddress)
 	if err != nil {
 		return
 	}
-	err = binary.Write(conn, binary.BigEndian, []byte(Config.MinecraftHost))
+	defer netConn.Close()
+
+	_, err = netConn.Write([]byte{0xFE, 0x01})
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(conn, binary.BigEndian, uint16(Config.MinecraftPort))
+	conn := bufio.NewReader(netConn)
+	kind, err := conn.ReadByte()
 	if err != nil {
 		return
 	}
+	if kind != 0xFF {
+		err = fmt.Errorf("unexpected legacy ping response packet: %#x", kind)
+		return
+	}
 
-	n = binary.PutUvarint(data, 1)
-	err = binary.Write(conn, binary.BigEndian, data[:n])
+	var length uint16
+	err = binary.Read(conn, binary.BigEndian, &length)
 	if err != nil {
 		return
 	}
-	// ??? but minecraft does it
-	err = binary.Write(conn, binary.BigEndian, data[:n])
+	utf16Buf := make([]uint16, length)
+	err = binary.Read(conn, binary.BigEndian, &utf16Buf)
 	if err != nil {
 		return
 	}
+	text := string(utf16.Decode(utf16Buf))
 
-	n = binary.PutUvarint(data, 0)
-	err = binary.Write(conn, binary.BigEndian, data[:n])
+	fields := strings.Split(text, "\x00")
+	// The "\xa7\x31" section marker is a UTF-16 code unit (U+00A7 "§"
+	// followed by "1"), which utf16.Decode turns into the UTF-8 encoding
+	// of "§1", not the raw bytes 0xa7 0x31.
+	if len(fields) < 6 || fields[0] != "§1" {
+		err = fmt.Errorf("unrecognized legacy ping response: %q", text)
+		return
+	}
+
+	protocol, _ := strconv.ParseUint(fields[1], 10, 64)
+	online, _ := strconv.ParseUint(fields[4], 10, 64)
+	max, _ := strconv.ParseUint(fields[5], 10, 64)
+
+	stat = &MinecraftStatus{
+		ProtocolVersion: protocol,
+		ServerVersion:   fields[2],
+		Motd:            fields[3],
+		Players:         online,
+		MaxPlayers:      max,
+	}
+	return
+}
+
+// getStatusQuery fetches status over the GS4 Query protocol (UDP).
+// http://wiki.vg/Query
+func getStatusQuery() (stat *MinecraftStatus, err error) {
+	log.Println("Querying", MinecraftQueryAddress)
+	conn, err := net.DialUDP("udp", nil, MinecraftQueryAddress)
 	if err != nil {
 		return
 	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
 
-	conn.Flush()
-	log.Println("Wrote a bunch of junk, about to read...")
+	sessionId := int32(rand.Int31() & 0x0F0F0F0F)
 
-	info := make(map[string]interface{})
+	// Handshake: magic, type 0x09, session id. Response is an ASCII
+	// challenge token we have to echo back (as a big-endian int32) in the
+	// full stat request.
+	handshake := make([]byte, 0, 7)
+	handshake = append(handshake, 0xFE, 0xFD, 0x09)
+	handshake = appendInt32(handshake, sessionId)
+	_, err = conn.Write(handshake)
+	if err != nil {
+		return
+	}
 
-	// Just throw away five bytes.
-	for i := 0; i < 5; i++ {
-		_, err = conn.ReadByte()
-		if err != nil {
+	challengeToken, err := readQueryChallenge(conn, sessionId)
+	if err != nil {
+		return
+	}
+
+	// Full stat request: type 0x00, session id, challenge token, then four
+	// padding bytes the protocol requires but ignores.
+	request := make([]byte, 0, 15)
+	request = append(request, 0xFE, 0xFD, 0x00)
+	request = appendInt32(request, sessionId)
+	request = appendInt32(request, challengeToken)
+	request = append(request, 0x00, 0x00, 0x00, 0x00)
+	_, err = conn.Write(request)
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+
+	return parseQueryStat(buf[:n])
+}
+
+func appendInt32(b []byte, v int32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// readQueryChallenge reads the handshake response and returns the decoded
+// challenge token, verifying the packet is addressed to our session.
+func readQueryChallenge(conn *net.UDPConn, sessionId int32) (token int32, err error) {
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+	if n < 5 || buf[0] != 0x09 {
+		err = fmt.Errorf("unexpected query handshake response: %x", buf[:n])
+		return
+	}
+	if int32(binary.BigEndian.Uint32(buf[1:5])) != sessionId {
+		err = fmt.Errorf("query handshake session id mismatch")
+		return
+	}
+	// The challenge token is the rest of the packet, a NUL-terminated ASCII
+	// decimal string.
+	tokenText := buf[5:n]
+	if i := indexByte(tokenText, 0); i >= 0 {
+		tokenText = tokenText[:i]
+	}
+	parsed, err := strconv.ParseInt(string(tokenText), 10, 64)
+	if err != nil {
+		return
+	}
+	token = int32(parsed)
+	return
+}
+
+func indexByte(b []byte, c byte) int {
+	for i, v := range b {
+		if v == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseQueryStat parses the full stat response: a key/value section
+// (NUL-terminated strings, alternating key then value, ending on an empty
+// key) followed by a player list section.
+func parseQueryStat(data []byte) (stat *MinecraftStatus, err error) {
+	if len(data) < 5 || data[0] != 0x00 {
+		err = fmt.Errorf("unexpected query stat response: %x", data)
+		return
+	}
+	// Skip the type byte, session id, and the "splitnum\x00\x80\x00"
+	// padding that precedes the key/value section.
+	body := data[5:]
+	const padding = "splitnum\x00\x80\x00"
+	if strings.HasPrefix(string(body), padding) {
+		body = body[len(padding):]
+	}
+
+	fields := make(map[string]string)
+	for {
+		key, rest, ok := splitNulString(body)
+		if !ok || key == "" {
+			body = rest
+			break
+		}
+		value, rest, ok := splitNulString(rest)
+		if !ok {
+			err = fmt.Errorf("truncated query stat key/value section")
 			return
 		}
+		fields[key] = value
+		body = rest
 	}
 
-	dec := json.NewDecoder(conn)
-	err = dec.Decode(&info)
+	// Player list section: "\x01player_\x00\x00" then NUL-terminated names,
+	// terminated by an extra NUL.
+	const playerHeader = "\x01player_\x00\x00"
+	var players []string
+	if strings.HasPrefix(string(body), playerHeader) {
+		body = body[len(playerHeader):]
+		for len(body) > 0 && body[0] != 0x00 {
+			name, rest, ok := splitNulString(body)
+			if !ok {
+				break
+			}
+			players = append(players, name)
+			body = rest
+		}
+	}
+
+	online, _ := strconv.ParseUint(fields["numplayers"], 10, 64)
+	max, _ := strconv.ParseUint(fields["maxplayers"], 10, 64)
+
+	stat = &MinecraftStatus{
+		ServerVersion: fields["version"],
+		Motd:          fields["hostname"],
+		Players:       online,
+		MaxPlayers:    max,
+		Plugins:       fields["plugins"],
+		Map:           fields["map"],
+		GameType:      fields["gametype"],
+		PlayerNames:   players,
+	}
+	return
+}
+
+func splitNulString(b []byte) (s string, rest []byte, ok bool) {
+	i := indexByte(b, 0)
+	if i < 0 {
+		return "", b, false
+	}
+	return string(b[:i]), b[i+1:], true
+}
+
+// BedrockStatus is the result of a RakNet unconnected ping against a
+// Bedrock Edition server. It mirrors MinecraftStatus but keeps the MOTD's
+// two lines and game edition separate, since Bedrock's pong string exposes
+// more than the Java ping does.
+type BedrockStatus struct {
+	Edition         string
+	Motd            string
+	SubMotd         string
+	ProtocolVersion uint64
+	ServerVersion   string
+	Players         uint64
+	MaxPlayers      uint64
+	GameMode        string
+}
+
+// offlineMessageDataId is RakNet's fixed magic value identifying an
+// unconnected ping/pong packet.
+var offlineMessageDataId = []byte{0x00, 0xff, 0xff, 0x00, 0xfe, 0xfe, 0xfe, 0xfe, 0xfd, 0xfd, 0xfd, 0xfd, 0x12, 0x34, 0x56, 0x78}
+
+// GetBedrockStatus fetches status from a Bedrock Edition server using
+// RakNet's unconnected ping/pong.
+// https://wiki.vg/Raknet_Protocol#Unconnected_Ping
+func GetBedrockStatus() (stat *BedrockStatus, err error) {
+	log.Println("Pinging Bedrock server at", MinecraftBedrockAddress)
+	conn, err := net.DialUDP("udp", nil, MinecraftBedrockAddress)
 	if err != nil {
 		return
 	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
 
-	//err = fmt.Errorf("LOL TLDR")
-	version := info["version"].(map[string]interface{})
-	players := info["players"].(map[string]interface{})
-	stat = &MinecraftStatus{
-		ProtocolVersion: uint64(version["protocol"].(float64)),
-		ServerVersion:   version["name"].(string),
-		Motd:            info["description"].(string),
-		Players:         uint64(players["online"].(float64)),
-		MaxPlayers:      uint64(players["max"].(float64)),
+	clientGuid := rand.Int63()
+
+	ping := make([]byte, 0, 33)
+	ping = append(ping, 0x01)
+	ping = appendInt64(ping, time.Now().UnixNano()/int64(time.Millisecond))
+	ping = append(ping, offlineMessageDataId...)
+	ping = appendInt64(ping, clientGuid)
+	_, err = conn.Write(ping)
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+
+	return parseUnconnectedPong(buf[:n])
+}
+
+func appendInt64(b []byte, v int64) []byte {
+	return append(b,
+		byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// parseUnconnectedPong decodes a RakNet unconnected pong packet. Its payload
+// is a length-prefixed, semicolon-delimited MOTD string:
+// MCPE;motd;protocol;version;online;max;serverId;subMotd;gamemode;...
+func parseUnconnectedPong(data []byte) (stat *BedrockStatus, err error) {
+	// The fixed header is id(1) + timestamp(8) + server guid(8) + magic(16)
+	// + string length(2) = 35 bytes, followed by the MOTD string itself.
+	if len(data) < 1 || data[0] != 0x1c {
+		err = fmt.Errorf("unexpected unconnected pong id: %x", data)
+		return
+	}
+	if len(data) < 35 {
+		err = fmt.Errorf("truncated unconnected pong: %x", data)
+		return
+	}
+	strLen := int(binary.BigEndian.Uint16(data[33:35]))
+	if 35+strLen > len(data) {
+		err = fmt.Errorf("truncated unconnected pong MOTD string")
+		return
+	}
+	motdString := string(data[35 : 35+strLen])
+	fields := strings.Split(motdString, ";")
+	field := func(i int) string {
+		if i < len(fields) {
+			return fields[i]
+		}
+		return ""
+	}
+
+	protocol, _ := strconv.ParseUint(field(2), 10, 64)
+	online, _ := strconv.ParseUint(field(4), 10, 64)
+	max, _ := strconv.ParseUint(field(5), 10, 64)
+
+	stat = &BedrockStatus{
+		Edition:         field(0),
+		Motd:            field(1),
+		ProtocolVersion: protocol,
+		ServerVersion:   field(3),
+		Players:         online,
+		MaxPlayers:      max,
+		SubMotd:         field(7),
+		GameMode:        field(8),
 	}
 	return
 }
 
-func StatusReport(msg *SlackMessage) (text string, err error) {
+func BedrockStatusReport(msg *SlackMessage) (text string, err error) {
+	stat, err := GetBedrockStatus()
+	if err != nil {
+		return
+	}
+
+	text = fmt.Sprintf("*%s* (Bedrock) has *%d*/%d players on.", stat.Motd, stat.Players, stat.MaxPlayers)
+	return
+}
+
+// StatusCache serves GetStatus results younger than ttl instead of
+// reconnecting to the Minecraft server for every Slack command, and
+// coalesces concurrent callers that land on a stale cache into a single
+// upstream probe.
+type StatusCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	stat      *MinecraftStatus
+	err       error
+	fetchedAt time.Time
+	pending   *statusFetch
+}
+
+// statusFetch tracks an in-flight GetStatus call so concurrent Get callers
+// can wait on it instead of starting their own.
+type statusFetch struct {
+	done chan struct{}
+	stat *MinecraftStatus
+	err  error
+}
+
+func NewStatusCache(ttl time.Duration) *StatusCache {
+	return &StatusCache{ttl: ttl}
+}
+
+func (c *StatusCache) Get() (*MinecraftStatus, error) {
+	c.mu.Lock()
+	if c.stat != nil && time.Since(c.fetchedAt) < c.ttl {
+		stat, err := c.stat, c.err
+		c.mu.Unlock()
+		return stat, err
+	}
+	if pending := c.pending; pending != nil {
+		c.mu.Unlock()
+		<-pending.done
+		return pending.stat, pending.err
+	}
+
+	pending := &statusFetch{done: make(chan struct{})}
+	c.pending = pending
+	c.mu.Unlock()
+
 	stat, err := GetStatus()
+
+	c.mu.Lock()
+	c.stat, c.err, c.fetchedAt = stat, err, time.Now()
+	c.pending = nil
+	c.mu.Unlock()
+
+	pending.stat, pending.err = stat, err
+	close(pending.done)
+
+	return stat, err
+}
+
+// Cache serves cached, single-flighted GetStatus results to Slack commands.
+// It's initialized in main once Config is loaded.
+var Cache *StatusCache
+
+// runPresencePoller periodically fetches status via Cache and posts
+// "X joined"/"X left" messages to channel whenever the player list changes.
+// It relies on PlayerNames, which only the Query backend and SLP's
+// optional players.sample field populate.
+func runPresencePoller(interval time.Duration, channel string) {
+	var known map[string]bool
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		known = pollPresenceOnce(channel, known)
+	}
+}
+
+// pollPresenceOnce runs a single presence poll tick and returns the
+// updated set of known player names. It's split out from the ticker loop
+// so a panic during one tick (from e.g. a malformed Query response) is
+// recovered and logged instead of silently ending the poller for good.
+func pollPresenceOnce(channel string, known map[string]bool) (current map[string]bool) {
+	defer recoverGoroutine("presence poller")
+	current = known
+
+	stat, err := Cache.Get()
+	if err != nil {
+		log.Println("Presence poll failed:", err)
+		return
+	}
+
+	current = make(map[string]bool, len(stat.PlayerNames))
+	for _, name := range stat.PlayerNames {
+		current[name] = true
+	}
+
+	if known != nil {
+		for name := range current {
+			if !known[name] {
+				postChatMessage(channel, fmt.Sprintf("*%s* joined.", name))
+			}
+		}
+		for name := range known {
+			if !current[name] {
+				postChatMessage(channel, fmt.Sprintf("*%s* left.", name))
+			}
+		}
+	}
+	return
+}
+
+func StatusReport(msg *SlackMessage) (text string, err error) {
+	stat, err := Cache.Get()
 	if err != nil {
 		return
 	}
@@ -152,17 +730,125 @@ func StatusRespond(msg *SlackMessage) (text string, err error) {
 	switch strings.ToLower(msg.Text) {
 	case "status":
 		text, err = StatusReport(msg)
+	case "bedrock":
+		if Config.BedrockHost == "" {
+			text = "No Bedrock server is configured."
+		} else {
+			text, err = BedrockStatusReport(msg)
+		}
 	default:
 		text = fmt.Sprintf("The term “%s” is not a known command.", msg.Text)
 	}
 
 	if err == nil {
-		text = fmt.Sprintf("%s: %s", msg.UserName, text)
+		who := msg.UserName
+		if who == "" {
+			who = msg.UserId
+		}
+		text = fmt.Sprintf("%s: %s", who, text)
 	}
 
 	return
 }
 
+// recoverGoroutine logs and swallows a panic in a goroutine that has no
+// caller left to recover it for us (net/http only does that for the
+// handler goroutine itself). Call it with defer as the first line of the
+// goroutine body.
+func recoverGoroutine(label string) {
+	if r := recover(); r != nil {
+		log.Printf("recovered from panic in %s: %v", label, r)
+	}
+}
+
+// verifySlackSignature checks req's X-Slack-Signature header against body
+// per Slack's v0 signing scheme, rejecting stale timestamps to guard
+// against replay.
+// https://api.slack.com/authentication/verifying-requests-from-slack
+func verifySlackSignature(req *http.Request, body []byte) bool {
+	timestamp := req.Header.Get("X-Slack-Request-Timestamp")
+	signature := req.Header.Get("X-Slack-Signature")
+	if timestamp == "" || signature == "" {
+		return false
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if time.Since(time.Unix(ts, 0)).Abs() > 5*time.Minute {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(Config.SlackSigningSecret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// postToResponseURL delivers a delayed slash command reply to responseURL,
+// Slack's stand-in for "reply to this specific invocation whenever you're
+// ready."
+func postToResponseURL(responseURL string, text string) error {
+	payload, err := json.Marshal(&SlackDelayedResponse{
+		ResponseType: "in_channel",
+		Text:         text,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(responseURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return nil
+}
+
+// postChatMessage posts text to a Slack channel via the chat.postMessage
+// API, used to reply to app_mention events (which have no response_url).
+// https://api.slack.com/methods/chat.postMessage
+func postChatMessage(channel string, text string) error {
+	resp, err := http.PostForm("https://slack.com/api/chat.postMessage", url.Values{
+		"token":   {Config.SlackToken},
+		"channel": {channel},
+		"text":    {text},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return nil
+}
+
+// appMentionPrefix strips the leading "<@U123ABC>" or "<@U123ABC|name>"
+// self-mention Slack prepends to app_mention event text.
+var appMentionPrefix = regexp.MustCompile(`^<@[^>]+>\s*`)
+
+// handleAppMention replies to an app_mention Events API event, so the bot
+// can be used by @-mentioning it in a channel instead of only via slash
+// command.
+func handleAppMention(event *SlackEvent) {
+	defer recoverGoroutine("app_mention reply")
+
+	msg := &SlackMessage{
+		ChannelName: event.Channel,
+		UserId:      event.User,
+		Text:        appMentionPrefix.ReplaceAllString(event.Text, ""),
+	}
+
+	text, err := StatusRespond(msg)
+	if err != nil {
+		text = fmt.Sprintf("Oops: %s", err.Error())
+	}
+	if err := postChatMessage(event.Channel, text); err != nil {
+		log.Println("Error posting app_mention reply:", err)
+	}
+}
+
 func main() {
 	var configPath string
 	flag.StringVar(&configPath, "config", "./config.json", "path to configuration file")
@@ -192,26 +878,48 @@ func main() {
 			return
 		}
 
-		trigger := req.PostFormValue("trigger_word")
-		fullText := req.PostFormValue("text")
-		text := strings.TrimSpace(strings.TrimPrefix(fullText, trigger))
-
-		msg := &SlackMessage{
-			ChannelName: req.PostFormValue("channel_name"),
-			UserName:    req.PostFormValue("user_name"),
-			UserId:      req.PostFormValue("user_id"),
-			Timestamp:   req.PostFormValue("timestamp"),
-			Trigger:     trigger,
-			Text:        text,
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if !verifySlackSignature(req, body) {
+			http.Error(w, "invalid signature", 401)
+			return
 		}
 
-		ret, err := StatusRespond(msg)
+		values, err := url.ParseQuery(string(body))
 		if err != nil {
-			ret = fmt.Sprintf("Oops: %s", err.Error())
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		msg := &SlackMessage{
+			ChannelName: values.Get("channel_name"),
+			UserName:    values.Get("user_name"),
+			UserId:      values.Get("user_id"),
+			Timestamp:   values.Get("timestamp"),
+			Trigger:     values.Get("command"),
+			Text:        strings.TrimSpace(values.Get("text")),
 		}
+		responseURL := values.Get("response_url")
+
+		// Slack gives us 3 seconds to ack a slash command; fetch the real
+		// status afterward and deliver it to response_url.
+		go func() {
+			defer recoverGoroutine("slash command response")
+
+			text, err := StatusRespond(msg)
+			if err != nil {
+				text = fmt.Sprintf("Oops: %s", err.Error())
+			}
+			if err := postToResponseURL(responseURL, text); err != nil {
+				log.Println("Error posting delayed slash command response:", err)
+			}
+		}()
 
 		response := &SlackResponse{
-			Text: ret,
+			Text: "One moment…",
 		}
 		responseText, err := json.Marshal(response)
 		if err != nil {
@@ -219,10 +927,43 @@ func main() {
 			return
 		}
 
-		w.Header().Set("Content-Type", "text/json")
+		w.Header().Set("Content-Type", "application/json")
 		w.Write([]byte(responseText))
 	})
 
+	http.HandleFunc("/slack/events", func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if !verifySlackSignature(req, body) {
+			http.Error(w, "invalid signature", 401)
+			return
+		}
+
+		var payload SlackEventPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		switch payload.Type {
+		case "url_verification":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, payload.Challenge)
+
+		case "event_callback":
+			if payload.Event.Type == "app_mention" {
+				go handleAppMention(&payload.Event)
+			}
+			w.WriteHeader(http.StatusOK)
+
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
 	address := fmt.Sprintf("%s:%d", Config.MinecraftHost, Config.MinecraftPort)
 	MinecraftAddress, err = net.ResolveTCPAddr("tcp", address)
 	if err != nil {
@@ -230,6 +971,47 @@ func main() {
 		return
 	}
 
+	queryPort := Config.QueryPort
+	if queryPort == 0 {
+		queryPort = Config.MinecraftPort
+	}
+	queryAddress := fmt.Sprintf("%s:%d", Config.MinecraftHost, queryPort)
+	MinecraftQueryAddress, err = net.ResolveUDPAddr("udp", queryAddress)
+	if err != nil {
+		log.Println("Error resolving Minecraft query address", queryAddress, ":", err.Error())
+		return
+	}
+
+	if Config.BedrockHost != "" {
+		bedrockAddress := fmt.Sprintf("%s:%d", Config.BedrockHost, Config.BedrockPort)
+		MinecraftBedrockAddress, err = net.ResolveUDPAddr("udp", bedrockAddress)
+		if err != nil {
+			log.Println("Error resolving Bedrock address", bedrockAddress, ":", err.Error())
+			return
+		}
+	}
+
+	cacheTTL := time.Duration(Config.CacheTTLSeconds) * time.Second
+	if cacheTTL <= 0 {
+		cacheTTL = 10 * time.Second
+	}
+	Cache = NewStatusCache(cacheTTL)
+
+	if Config.PresenceChannel != "" {
+		// PlayerNames is only trustworthy from the Query backend; SLP's
+		// players.sample is server-capped/shuffled and diffing it spams
+		// bogus joined/left messages.
+		if Config.StatusBackend != "query" {
+			log.Println("PresenceChannel is set but StatusBackend is not \"query\"; not starting the presence poller")
+		} else {
+			pollInterval := time.Duration(Config.PresencePollSeconds) * time.Second
+			if pollInterval <= 0 {
+				pollInterval = cacheTTL
+			}
+			go runPresencePoller(pollInterval, Config.PresenceChannel)
+		}
+	}
+
 	// Try immediately if we're in debug mode.
 	if Config.Debug {
 		stat, err := GetStatus()